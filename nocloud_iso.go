@@ -0,0 +1,213 @@
+/*
+   This file implements just enough of ISO9660 (ECMA-119) to produce a
+   NoCloud cloud-init seed image: a flat, single-directory, non-Rock-Ridge,
+   non-Joliet disc with a "cidata" volume label. Linux's isofs driver
+   lower-cases plain ISO9660 names and strips the ";1" version suffix by
+   default, which is how real-world cidata.iso images get away with file
+   names like "user-data" that aren't strictly valid d-characters.
+*/
+
+package main ;
+
+import (
+  "bytes"
+  "sort"
+  "errors"
+  "encoding/binary"
+) ;
+
+const iso_sector_size = 2048 ;
+
+func isoLsb32 (n uint32) []byte {
+  b := make([]byte, 4) ;
+  binary.LittleEndian.PutUint32 (b, n) ;
+  return b ;
+}
+
+func isoMsb32 (n uint32) []byte {
+  b := make([]byte, 4) ;
+  binary.BigEndian.PutUint32 (b, n) ;
+  return b ;
+}
+
+func isoBoth32 (n uint32) []byte {
+  return append (isoLsb32 (n), isoMsb32 (n)...) ;
+}
+
+func isoLsb16 (n uint16) []byte {
+  b := make([]byte, 2) ;
+  binary.LittleEndian.PutUint16 (b, n) ;
+  return b ;
+}
+
+func isoMsb16 (n uint16) []byte {
+  b := make([]byte, 2) ;
+  binary.BigEndian.PutUint16 (b, n) ;
+  return b ;
+}
+
+func isoBoth16 (n uint16) []byte {
+  return append (isoLsb16 (n), isoMsb16 (n)...) ;
+}
+
+func isoPad (s string, n int) []byte {
+  b := make([]byte, n) ;
+  for i := range (b) {
+    b[i] = ' ' ;
+  }
+  copy (b, s) ;
+  return b ;
+}
+
+/*
+   This builds one ISO9660 directory record. "id" is the raw file/directory
+   identifier bytes - pass []byte{0x00} for "." (self) and []byte{0x01} for
+   ".." (parent). "flags" is the file flag byte (2 = directory, 0 = file).
+*/
+
+func isoDirRecord (id []byte, flags byte, extent, length uint32) []byte {
+  id_len := len (id) ;
+  rec_len := 33 + id_len ;
+  if (rec_len % 2 != 0) {
+    rec_len++ ;
+  }
+  rec := make([]byte, rec_len) ;
+  rec[0] = byte (rec_len) ;
+  copy (rec[2:10], isoBoth32 (extent)) ;
+  copy (rec[10:18], isoBoth32 (length)) ;
+  copy (rec[18:25], []byte { 120, 1, 1, 0, 0, 0, 0 }) ; /* 2020-01-01 UTC */
+  rec[25] = flags ;
+  copy (rec[28:32], isoBoth16 (1)) ;
+  rec[32] = byte (id_len) ;
+  copy (rec[33:33+id_len], id) ;
+  return rec ;
+}
+
+func isoBuildPathTable (root_extent uint32, big_endian bool) []byte {
+  b := make([]byte, iso_sector_size) ;
+  b[0] = 1 ;
+  if (big_endian) {
+    copy (b[2:6], isoMsb32 (root_extent)) ;
+    copy (b[6:8], isoMsb16 (1)) ;
+  } else {
+    copy (b[2:6], isoLsb32 (root_extent)) ;
+    copy (b[6:8], isoLsb16 (1)) ;
+  }
+  return b ;
+}
+
+const iso_path_table_size = 10 ;
+
+func isoBuildPVD (vol_id string, root_rec []byte, path_table_size,
+                  pt_l_loc, pt_m_loc, total_sectors uint32) []byte {
+  b := make([]byte, iso_sector_size) ;
+  b[0] = 1 ;
+  copy (b[1:6], []byte ("CD001")) ;
+  b[6] = 1 ;
+  copy (b[8:40], isoPad ("", 32)) ;
+  copy (b[40:72], isoPad (vol_id, 32)) ;
+  copy (b[80:88], isoBoth32 (total_sectors)) ;
+  copy (b[120:124], isoBoth16 (1)) ;
+  copy (b[124:128], isoBoth16 (1)) ;
+  copy (b[128:132], isoBoth16 (uint16(iso_sector_size))) ;
+  copy (b[132:140], isoBoth32 (path_table_size)) ;
+  copy (b[140:144], isoLsb32 (pt_l_loc)) ;
+  copy (b[148:152], isoMsb32 (pt_m_loc)) ;
+  copy (b[156:190], root_rec) ;
+  blank_date := make([]byte, 17) ;
+  for i := 0; i < 16; i++ {
+    blank_date[i] = '0' ;
+  }
+  copy (b[813:830], blank_date) ;
+  copy (b[830:847], blank_date) ;
+  copy (b[847:864], blank_date) ;
+  copy (b[864:881], blank_date) ;
+  b[881] = 1 ;
+  return b ;
+}
+
+/*
+   This function renders a flat NoCloud seed ISO ("cidata") containing
+   "files" (eg user-data, meta-data, network-config) and returns the raw
+   ISO image bytes.
+*/
+
+func f_buildNoCloudISO (files map[string] []byte) ([]byte, error) {
+
+  names := make([]string, 0, len(files)) ;
+  for k := range (files) {
+    names = append (names, k) ;
+  }
+  sort.Strings (names) ;
+
+  /*
+     sector layout: 0-15 system area, 16 PVD, 17 terminator, 18 path table
+     (L), 19 path table (M), 20 root directory, 21+ file data
+  */
+
+  root_extent := uint32 (20) ;
+  next_extent := uint32 (21) ;
+
+  type fileEntry struct {
+    Name string ;
+    Extent uint32 ;
+    Length uint32 ;
+  }
+  var entries []fileEntry ;
+  var data_sectors [][]byte ;
+
+  for _, name := range (names) {
+    content := files[name] ;
+    n_sectors := (len(content) + iso_sector_size - 1) / iso_sector_size ;
+    if (n_sectors == 0) {
+      n_sectors = 1 ;
+    }
+    padded := make([]byte, n_sectors * iso_sector_size) ;
+    copy (padded, content) ;
+    entries = append (entries, fileEntry { name, next_extent, uint32(len(content)) }) ;
+    for s := 0; s < n_sectors; s++ {
+      data_sectors = append (data_sectors, padded[s*iso_sector_size:(s+1)*iso_sector_size]) ;
+    }
+    next_extent += uint32 (n_sectors) ;
+  }
+
+  root_rec := isoDirRecord ([]byte{0}, 2, root_extent, iso_sector_size) ;
+
+  root_sector := make([]byte, iso_sector_size) ;
+  off := 0 ;
+  self_rec := isoDirRecord ([]byte{0}, 2, root_extent, iso_sector_size) ;
+  copy (root_sector[off:], self_rec) ;
+  off += len (self_rec) ;
+  parent_rec := isoDirRecord ([]byte{1}, 2, root_extent, iso_sector_size) ;
+  copy (root_sector[off:], parent_rec) ;
+  off += len (parent_rec) ;
+  for _, e := range (entries) {
+    rec := isoDirRecord ([]byte(e.Name), 0, e.Extent, e.Length) ;
+    if (off + len(rec) > iso_sector_size) {
+      return nil, errors.New ("nocloud iso: too many seed files for one directory sector") ;
+    }
+    copy (root_sector[off:], rec) ;
+    off += len (rec) ;
+  }
+
+  path_table_l := isoBuildPathTable (root_extent, false) ;
+  path_table_m := isoBuildPathTable (root_extent, true) ;
+  pvd := isoBuildPVD ("cidata", root_rec, iso_path_table_size, 18, 19, next_extent) ;
+
+  vdst := make([]byte, iso_sector_size) ;
+  vdst[0] = 255 ;
+  copy (vdst[1:6], []byte ("CD001")) ;
+  vdst[6] = 1 ;
+
+  var buf bytes.Buffer ;
+  buf.Write (make([]byte, 16 * iso_sector_size)) ;
+  buf.Write (pvd) ;
+  buf.Write (vdst) ;
+  buf.Write (path_table_l) ;
+  buf.Write (path_table_m) ;
+  buf.Write (root_sector) ;
+  for _, s := range (data_sectors) {
+    buf.Write (s) ;
+  }
+  return buf.Bytes (), nil ;
+}
@@ -5,20 +5,61 @@
      ceph_hosts - a list of ceph admin hosts ceph_hosts
      qemu_hosts - a list of qemu hypevisor hosts
      ssh_private_key - path to key for logging into ceph and hypervisor hosts
+     migrate_max_bandwidth_mbps - cap on live migration bandwidth (default 220)
+     migrate_max_downtime_ms - cap on live migration downtime (default 300)
+     vm_index_cache - (optional) local file caching the vm id -> host index
+     seed_pool - rbd pool used to stage cloud-init seed ISOs (default "rbd")
+     placement_strategy - (optional) how f_getHypervisor() picks a host for
+                  a new/migrating VM : "most-free-mem" (default), a weighted
+                  score of mem/cpu headroom/load/disk ; "least-loaded", by
+                  1-minute loadavg alone ; "round-robin", cycling through
+                  qemu_hosts ; "pinned", always honoring the VM's own
+                  target_host
+     sched_weight_mem, sched_weight_cpu, sched_weight_load, sched_weight_disk
+                  - (optional) weights used to combine a host's free memory
+                  (GB), spare vCPU headroom, 1-minute loadavg and free disk
+                  (GB) into one score under "most-free-mem"
 
    For each rbd image resource, we need to know
      osd_pool - the pool the rbd image will live in
      img_name - name of the rbd image
-     img_size - size of the rbd image
+     img_size - size of the rbd image. Changing this on an existing image
+                triggers an "rbd resize", followed by a QMP "block_resize"
+                against any running VM whose disk uses this image.
+
+   For each rbd snapshot resource, we need to know
+     osd_pool - the pool the image being snapshotted lives in
+     img_name - name of the image being snapshotted
+     snap_name - name of the snapshot
+     protect - (optional) protect the snapshot, required before it can be
+               cloned
+
+   For each rbd clone resource, we need to know
+     parent_pool, parent_img, parent_snap - the protected snapshot to clone
+     child_pool, child_img - where the new, writable clone is created
 
    For each qemu VM resource, we need to know
      name - the name of the VM
      cpus - number of vCPUs
      mem_mb - amount of memory
-     vlan - the VLAN the NIC is attached to
-     mac - the mac address of the NIC
+     max_cpus - (optional) "maxcpus" ceiling booted for cpu-add hotplug
+                headroom (default 64)
+     mem_slots - (optional) "slots" of dimm hotplug headroom booted for
+                 device_add pc-dimm (default 16)
+     max_mem_mb - (optional) "maxmem" ceiling booted for dimm hotplug
+                  headroom (default 65536)
      vnc - the display instance, eg (":10")
-     img_name - the RBD image that will be the OS disk
+     disk - one or more { osd_pool, img_name, cache } blocks, first is the
+            OS disk
+     nic - one or more { vlan, mac } blocks
+     fs - (optional) one or more { host_path, mount_tag } virtio-fs blocks
+     pmem - (optional) one or more { osd_pool, img_name, size_mb } blocks
+     allow_migrate - (optional) allow this VM to be live-migrated on Update
+     preferred_host - (optional) hypervisor to live-migrate this VM onto
+     target_host - (optional) hypervisor to launch this VM on when the
+                  provider's placement_strategy is "pinned"
+     cloud_init - (optional) { user_data, meta_data, network_config,
+                  hostname } block, seeded via a NoCloud cdrom image
 
    Thus, here is a reference terraform configuration that uses this provider
    to provision an RBD image and then instantiate a qemu VM.
@@ -40,11 +81,15 @@
        name = "helloVm"
        cpus = 1
        mem_mb = 2048
-       vlan = 10
-       mac = "de:ad:be:ef:ca:fe"
        vnc = ":10"
-       osd_pool = "rbd"
-       img_name = "helloImg"
+       disk {
+         osd_pool = "rbd"
+         img_name = "helloImg"
+       }
+       nic {
+         vlan = 10
+         mac = "de:ad:be:ef:ca:fe"
+       }
        depends_on = [rbd_image.helloImg]
      }
 
@@ -73,28 +118,58 @@ import (
   "os/exec"
   "fmt"
   "time"
+  "sync"
   "bufio"
-  "regexp"
   "errors"
   "strconv"
   "strings"
   "runtime"
+  "path/filepath"
+) ;
+
+/* my personal imports, for talking QMP to a running qemu */
+
+import (
+  "encoding/json"
+  "crypto/sha256"
 ) ;
 
 const cfg_providerName string = "rbdqemu" ;
 const cfg_rbdResourceName string = cfg_providerName + "_image" ;
 const cfg_vmResourceName string = cfg_providerName + "_vm" ;
+const cfg_snapResourceName string = cfg_providerName + "_snapshot" ;
+const cfg_cloneResourceName string = cfg_providerName + "_clone" ;
 const cfg_vmNamePrefix = "tf" ;
 const cfg_logFile string = "provider.log" ;
 const cfg_logMaxSize int64 = 131072 ;
 
 const cfg_qemu_sys = "/usr/local/packages/qemu-4.1.0/bin/qemu-system-x86_64" ;
 const cfg_qemu_img = "/usr/local/packages/qemu-4.1.0/bin/qemu-img" ;
+const cfg_qemu_qmp_dir = "/var/run/qemu" ;
+const cfg_qemu_migrate_port = 4444 ;
+const cfg_migrate_poll_tries = 60 ;
+const cfg_migrate_poll_interval = 2 * time.Second ;
+const cfg_vm_state_dir = "/var/lib/rbdqemu/vms" ;
+const cfg_sched_max_parallel = 8 ;
+const cfg_sched_lock_path = "/var/lock/rbdqemu.sched.lock" ;
 
 var G_ssh_private_key string ;
 var G_ceph_rbduser string ;
 var G_ceph_hosts []string ;
 var G_qemu_hosts []string ;
+var G_migrate_max_bandwidth_mbps int ;
+var G_migrate_max_downtime_ms int ;
+var G_vm_index_cache string ;
+var G_vm_index map[string] string ;
+var G_vm_index_mu sync.Mutex ;
+var G_seed_pool string ;
+var G_placement_strategy string ;
+var G_sched_weight_mem float64 ;
+var G_sched_weight_cpu float64 ;
+var G_sched_weight_load float64 ;
+var G_sched_weight_disk float64 ;
+var G_rr_index int ;
+var G_rr_mu sync.Mutex ;
 
 /* ------------------------------------------------------------------------- */
 
@@ -193,6 +268,69 @@ func f_ssh (host, rcmd string) (string, string, error) {
   return out_buf, err_buf, ssh.Wait() ;
 }
 
+/*
+   This is identical to f_ssh() above, except "stdin" is fed to the remote
+   command's standard input. This is used to stream locally-generated
+   content (eg a NoCloud seed ISO) to a remote command without first
+   staging it as a file on either end.
+*/
+
+func f_sshStdin (host, rcmd string, stdin []byte) (string, string, error) {
+
+  ssh_args := [] string { "-i", G_ssh_private_key,
+                          "-o", "StrictHostKeyChecking=no",
+                          "-o", "BatchMode=yes",
+                          "root@" + host, rcmd } ;
+  ssh := exec.Command ("ssh", ssh_args...) ;
+  stdin_pipe, _ := ssh.StdinPipe () ;
+  stdout, _ := ssh.StdoutPipe () ;
+  stderr, _ := ssh.StderrPipe () ;
+  r_out := bufio.NewReader (stdout) ;
+  r_err := bufio.NewReader (stderr) ;
+  f_log (fmt.Sprintf ("connecting to %s (stdin).", host)) ;
+  err := ssh.Start () ;
+  if (err != nil) {
+    f_log (fmt.Sprintf ("FATAL! Cannot exec ssh - %s", err)) ;
+    return "", "", nil ;
+  }
+
+  go func () {
+    stdin_pipe.Write (stdin) ;
+    stdin_pipe.Close () ;
+  } () ;
+
+  /* read whatever comes out from the command and log it */
+
+  var out_buf, err_buf string ;
+
+  for {
+    line, _, err := r_out.ReadLine () ;
+    if (err != nil) {
+      break ;
+    }
+    f_log ("stdout:" + string(line)) ;
+    if (len(out_buf) == 0) {
+      out_buf = string(line) ;
+    } else {
+      out_buf = out_buf + "\n" + string(line) ;
+    }
+  }
+  for {
+    line, _, err := r_err.ReadLine () ;
+    if (err != nil) {
+      break ;
+    }
+    f_log ("stderr:" + string(line)) ;
+    if (len(err_buf) == 0) {
+      err_buf = string(line) ;
+    } else {
+      err_buf = err_buf + "\n" + string(line) ;
+    }
+  }
+
+  return out_buf, err_buf, ssh.Wait() ;
+}
+
 /* ------------------------------------------------------------------------- */
 
 /*
@@ -227,43 +365,227 @@ func f_rbdExists (osd_pool, img_name string) (bool, error) {
 }
 
 /*
-   This function performs an ssh to each hypervisor, returning the host with
-   the most amount of free memory (which must be more than "mem_mb").
+   This is the per-host snapshot gathered by f_probeHost() below: how much
+   memory is free, how many vCPUs are already committed by our own running
+   "tf-*" qemus vs "nproc", the 1-minute loadavg, and free disk space under
+   the qemu binary's directory.
 */
 
-func f_getHypervisor (mem_mb int) string {
+type hostScore struct {
+  Host string ;
+  MemAvailKb int ;
+  Nproc int ;
+  RunningVcpus int ;
+  Load1 float64 ;
+  FreeDiskKb int64 ;
+}
 
-  var max_avail int ;
-  var best_host string ;
-  max_avail = 0 ;
-  best_host = "" ;
+/*
+   This function ssh's to "host" once, gathering all the raw numbers
+   f_scoreHost() below needs. "ps" is grepped for our own "-name tf-..."
+   qemus and their "-smp" vcpu counts are summed, so we know how
+   oversubscribed the host already is versus its physical core count.
+*/
 
-  for _, v := range (G_qemu_hosts) {
+func f_probeHost (host string) (hostScore, error) {
 
-    /*
-       each host should return something like :
-         MemAvailable:     131744 kB
-    */
+  var hs hostScore ;
+  hs.Host = host ;
 
-    out_buf, err_buf, fault := f_ssh (v, "grep MemAvailable /proc/meminfo") ;
-    if ((fault != nil) || (len(err_buf) > 0)) {
-      f_log (fmt.Sprintf ("ignoring %s.", v)) ;
-    } else {
-      tokens  := regexp.MustCompile("[ \t]+").Split(out_buf, -1) ;
-      avail_kb, _ := strconv.Atoi (tokens[1]) ;
-      if (avail_kb > max_avail) {
-        max_avail = avail_kb ;
-        best_host = v ;
+  rcmd := fmt.Sprintf (
+    "echo MEM:$(grep MemAvailable /proc/meminfo | awk '{print $2}'); " +
+    "echo NPROC:$(nproc); " +
+    "echo LOAD:$(cut -d' ' -f1 /proc/loadavg); " +
+    "echo DISK:$(df -Pk %s | tail -1 | awk '{print $4}'); " +
+    "echo SMP:$(ps axwww -o args= | grep -- '-name %s-' | " +
+    "grep -oE -- '-smp [0-9]+' | awk '{s+=$2} END {print s+0}')",
+    filepath.Dir (cfg_qemu_sys), cfg_vmNamePrefix) ;
+  out_buf, err_buf, fault := f_ssh (host, rcmd) ;
+  if (fault != nil) {
+    return hs, fault ;
+  }
+  if (len(err_buf) > 0) {
+    return hs, errors.New (err_buf) ;
+  }
+
+  for _, line := range (strings.Split (out_buf, "\n")) {
+    fields := strings.SplitN (line, ":", 2) ;
+    if (len(fields) != 2) {
+      continue ;
+    }
+    val := strings.TrimSpace (fields[1]) ;
+    switch (fields[0]) {
+    case "MEM":
+      hs.MemAvailKb, _ = strconv.Atoi (val) ;
+    case "NPROC":
+      hs.Nproc, _ = strconv.Atoi (val) ;
+    case "LOAD":
+      hs.Load1, _ = strconv.ParseFloat (val, 64) ;
+    case "DISK":
+      hs.FreeDiskKb, _ = strconv.ParseInt (val, 10, 64) ;
+    case "SMP":
+      hs.RunningVcpus, _ = strconv.Atoi (val) ;
+    }
+  }
+  return hs, nil ;
+}
+
+/*
+   This function probes every host in "hosts" concurrently, capped at
+   cfg_sched_max_parallel ssh's in flight at once, and returns a score for
+   every host that answered. Unreachable hosts are logged and dropped
+   rather than failing the whole scheduling pass.
+*/
+
+func f_probeHosts (hosts []string) []hostScore {
+
+  results := make ([]hostScore, len(hosts)) ;
+  ok := make ([]bool, len(hosts)) ;
+  var wg sync.WaitGroup ;
+  sem := make (chan struct{}, cfg_sched_max_parallel) ;
+
+  for i, host := range (hosts) {
+    wg.Add (1) ;
+    go func (i int, host string) {
+      defer wg.Done () ;
+      sem <- struct{}{} ;
+      defer func () { <-sem } () ;
+      hs, fault := f_probeHost (host) ;
+      if (fault != nil) {
+        f_log (fmt.Sprintf ("ignoring %s - %s", host, fault)) ;
+        return ;
       }
+      results[i] = hs ;
+      ok[i] = true ;
+    } (i, host) ;
+  }
+  wg.Wait () ;
+
+  var scores []hostScore ;
+  for i, hs := range (results) {
+    if (ok[i]) {
+      scores = append (scores, hs) ;
+    }
+  }
+  return scores ;
+}
+
+/*
+   This combines a hostScore into a single weighted number, higher is
+   better, using the provider's sched_weight_* options. "cpu headroom" is
+   nproc minus the vcpus already committed by our own running qemus.
+*/
+
+func f_scoreHost (hs hostScore) float64 {
+  mem_gb := float64 (hs.MemAvailKb) / 1024.0 / 1024.0 ;
+  cpu_headroom := float64 (hs.Nproc - hs.RunningVcpus) ;
+  disk_gb := float64 (hs.FreeDiskKb) / 1024.0 / 1024.0 ;
+  return (G_sched_weight_mem * mem_gb) +
+         (G_sched_weight_cpu * cpu_headroom) -
+         (G_sched_weight_load * hs.Load1) +
+         (G_sched_weight_disk * disk_gb) ;
+}
+
+/*
+   This function picks the hypervisor to launch a VM needing "mem_mb" of
+   memory and "cpus" vCPUs on, honoring the provider's "placement_strategy" :
+     most-free-mem - (default) weighted score of mem/cpu headroom/load/disk
+     least-loaded  - lowest 1-minute loadavg, ignoring the other scores
+     round-robin   - cycles through qemu_hosts, ignoring load entirely
+     pinned        - always returns "target_host" (the VM's own attribute)
+   For the scored strategies, a host is dropped if it doesn't actually have
+   "mem_mb" of free memory or "cpus" of spare vCPU headroom.
+*/
+
+func f_getHypervisor (mem_mb, cpus int, target_host string) string {
+
+  if (strings.Compare (G_placement_strategy, "pinned") == 0) {
+    if (len(target_host) == 0) {
+      f_log ("WARNING: placement_strategy=pinned but target_host is unset.") ;
+      return "" ;
+    }
+    f_log ("pinned to " + target_host) ;
+    return target_host ;
+  }
+
+  if (strings.Compare (G_placement_strategy, "round-robin") == 0) {
+    if (len(G_qemu_hosts) == 0) {
+      return "" ;
+    }
+    G_rr_mu.Lock () ;
+    h := G_qemu_hosts[G_rr_index % len(G_qemu_hosts)] ;
+    G_rr_index++ ;
+    G_rr_mu.Unlock () ;
+    f_log (fmt.Sprintf ("round-robin -> %s", h)) ;
+    return h ;
+  }
+
+  scores := f_probeHosts (G_qemu_hosts) ;
+  var best_host string ;
+  var best_score float64 ;
+
+  for _, hs := range (scores) {
+    if (hs.MemAvailKb / 1024 <= mem_mb) {
+      f_log (fmt.Sprintf ("ignoring %s, not enough mem.", hs.Host)) ;
+      continue ;
+    }
+    if (hs.Nproc - hs.RunningVcpus < cpus) {
+      f_log (fmt.Sprintf ("ignoring %s, not enough cpu headroom.", hs.Host)) ;
+      continue ;
+    }
+
+    var score float64 ;
+    if (strings.Compare (G_placement_strategy, "least-loaded") == 0) {
+      score = 0 - hs.Load1 ;
+    } else {
+      score = f_scoreHost (hs) ;
+    }
+    f_log (fmt.Sprintf ("%s mem:%dkb nproc:%d vcpus:%d load:%.2f disk:%dkb score:%.2f",
+                        hs.Host, hs.MemAvailKb, hs.Nproc, hs.RunningVcpus,
+                        hs.Load1, hs.FreeDiskKb, score)) ;
+    if (len(best_host) == 0) || (score > best_score) {
+      best_score = score ;
+      best_host = hs.Host ;
     }
   }
 
-  f_log (fmt.Sprintf ("max_avail:%dkb best_host:%s", max_avail, best_host)) ;
-  if (max_avail / 1024 > mem_mb) {
-    return best_host ;
+  if (len(best_host) == 0) {
+    f_log (fmt.Sprintf ("WARNING: No hypervisor with %dMB free, %d vcpus spare.", mem_mb, cpus)) ;
   }
-  f_log (fmt.Sprintf ("WARNING: No hypervisor with %dMB free.", mem_mb)) ;
-  return "" ;
+  return best_host ;
+}
+
+/*
+   This wraps "rcmd" (the qemu launch itself) in an flock(1) against
+   cfg_sched_lock_path on "host", so that two parallel Creates which both
+   picked "host" off the back of f_getHypervisor() serialize rather than
+   racing to launch past each other's view of available memory/cpu.
+
+   f_getHypervisor()'s scoring pass runs unlocked, so by the time we get
+   here another launch may already have landed on "host" first - while
+   we're waiting on the flock, a sibling Create can consume the headroom
+   we originally scored it for. So once the lock is ours, we re-check
+   "mem_mb"/"cpus" headroom is still there before actually running "rcmd",
+   aborting rather than overcommitting the host. The lock is released as
+   soon as the check+launch returns - qemu is started with "-daemonize",
+   so that's a short window, not the VM's whole lifetime.
+*/
+
+func f_sshLocked (host, rcmd string, mem_mb, cpus int) (string, string, error) {
+  recheck := fmt.Sprintf (
+    "avail_kb=$(grep MemAvailable /proc/meminfo | awk '{print $2}'); " +
+    "used_vcpus=$(ps axwww -o args= | grep -- '-name %s-' | " +
+    "grep -oE -- '-smp [0-9]+' | awk '{s+=$2} END {print s+0}'); " +
+    "if [ \"$avail_kb\" -le %d ]; then " +
+    "echo 'reserved host no longer has enough free mem' >&2; exit 1; fi; " +
+    "if [ $(($(nproc) - used_vcpus)) -lt %d ]; then " +
+    "echo 'reserved host no longer has enough spare vcpus' >&2; exit 1; fi; ",
+    cfg_vmNamePrefix, mem_mb * 1024, cpus) ;
+  /* single-quoted, so the remote login shell doesn't expand the re-check's
+     $(...) and $vars before flock is held */
+  locked_cmd := fmt.Sprintf ("flock %s -c '%s'", cfg_sched_lock_path,
+                             strings.ReplaceAll (recheck + rcmd, "'", `'\''`)) ;
+  return f_ssh (host, locked_cmd) ;
 }
 
 /* ------------------------------------------------------------------------- */
@@ -301,7 +623,7 @@ func rsRbdCreate (d *schema.ResourceData, m interface{}) error {
 
   /* pick a hypervisor host and run "qemu-img create ..." */
 
-  h := f_getHypervisor (1) ;
+  h := f_getHypervisor (1, 0, "") ;
   if (len(h) < 1) {
     return nil ;
   }
@@ -334,9 +656,133 @@ func rsRbdRead (d *schema.ResourceData, m interface{}) error {
   return nil ;
 }
 
+/*
+   This function parses an rbd "--size" value (eg "6M", "10G", "2T", or a
+   bare number which rbd treats as MB) and returns it in MB.
+*/
+
+func f_parseRbdSize (img_size string) (int, error) {
+  s := strings.TrimSpace (img_size) ;
+  if (len(s) == 0) {
+    return 0, errors.New ("empty img_size") ;
+  }
+  mult := 1 ;
+  num_str := s ;
+  switch (s[len(s)-1]) {
+  case 'M', 'm':
+    mult = 1 ;
+    num_str = s[:len(s)-1] ;
+  case 'G', 'g':
+    mult = 1024 ;
+    num_str = s[:len(s)-1] ;
+  case 'T', 't':
+    mult = 1024 * 1024 ;
+    num_str = s[:len(s)-1] ;
+  }
+  n, err := strconv.Atoi (num_str) ;
+  if (err != nil) {
+    return 0, err ;
+  }
+  return n * mult, nil ;
+}
+
+/*
+   This returns the QMP/QOM id f_qemuLaunchCmd() pins to the i'th "-drive",
+   so f_resizeRunningVms() below always has a stable target for
+   "block_resize" - qemu's auto-assigned ids aren't something we can
+   reconstruct after the fact.
+*/
+
+func f_diskDriveId (i int) string {
+  return fmt.Sprintf ("drive%d", i) ;
+}
+
+/*
+   This function scans every hypervisor's VM state directory for VMs whose
+   config recorded a disk on "osd_pool"/"img_name", and issues a QMP
+   "block_resize" against each one it finds, so a running guest notices the
+   new size without needing a reboot. Every state file on a host is written
+   as a single line of JSON (see f_writeVmState()), so "cat"-ing the whole
+   directory in one ssh gives us one JSON object per line to unmarshal. Any
+   failure here is logged as a warning rather than returned - the resize of
+   the underlying rbd image, done by the caller, already succeeded and is
+   the operation of record.
+*/
+
+func f_resizeRunningVms (osd_pool, img_name string, new_size_mb int) {
+
+  target := osd_pool + "/" + img_name ;
+
+  for _, host := range (G_qemu_hosts) {
+    out_buf, _, fault := f_ssh (host, fmt.Sprintf ("cat %s/*.json 2>/dev/null", cfg_vm_state_dir)) ;
+    if (fault != nil) || (len(out_buf) == 0) {
+      continue ;
+    }
+    for _, line := range (strings.Split (out_buf, "\n")) {
+      var state vmState ;
+      if err := json.Unmarshal ([]byte(line), &state); err != nil {
+        continue ;
+      }
+      for i, disk := range (state.Disks) {
+        if (strings.Compare (disk.OsdPool + "/" + disk.ImgName, target) != 0) {
+          continue ;
+        }
+        dev_id := f_diskDriveId (i) ;
+        f_log (fmt.Sprintf ("block_resize %s on %s (%s) -> %dMB", dev_id, host, state.QmpSocket, new_size_mb)) ;
+        _, fault := f_qmpCommand (host, state.QmpSocket, f_qmpBuild ("block_resize",
+                                  map[string] interface{} {
+                                    "device": dev_id,
+                                    "size": new_size_mb * 1024 * 1024,
+                                  })) ;
+        if (fault != nil) {
+          f_log (fmt.Sprintf ("WARNING: block_resize on %s - %s", host, fault)) ;
+        }
+      }
+    }
+  }
+}
+
 func rsRbdUpdate (d *schema.ResourceData, m interface{}) error {
-  f_log ("") ;
-  return errors.New ("feature not implemented") ;
+
+  osd_pool := d.Get("osd_pool").(string) ;
+  img_name := d.Get("img_name").(string) ;
+
+  if !d.HasChange ("img_size") {
+    return nil ;
+  }
+  old_size, new_size := d.GetChange ("img_size") ;
+  old_size_str, new_size_str := old_size.(string), new_size.(string) ;
+  f_log (fmt.Sprintf ("%s/%s -> %s", osd_pool, img_name, new_size_str)) ;
+
+  /* "rbd resize" refuses to shrink an image without --allow-shrink - only
+     pass it when the new size is actually smaller, so a typo'd img_size
+     can't silently truncate data past that guard */
+
+  shrink_flag := "" ;
+  old_size_mb, old_err := f_parseRbdSize (old_size_str) ;
+  new_size_mb_chk, new_err := f_parseRbdSize (new_size_str) ;
+  if (old_err == nil) && (new_err == nil) && (new_size_mb_chk < old_size_mb) {
+    shrink_flag = "--allow-shrink " ;
+  }
+
+  rbd_cmd := fmt.Sprintf ("rbd resize %s--size %s %s/%s",
+                          shrink_flag, new_size_str, osd_pool, img_name) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+
+  new_size_mb, err := f_parseRbdSize (new_size_str) ;
+  if (err != nil) {
+    f_log (fmt.Sprintf ("WARNING: cannot parse img_size %s - %s", new_size_str, err)) ;
+    return nil ;
+  }
+  f_resizeRunningVms (osd_pool, img_name, new_size_mb) ;
+  return nil ;
 }
 
 func rsRbdDelete (d *schema.ResourceData, m interface{}) error {
@@ -372,162 +818,1195 @@ func rsRbdExists (d *schema.ResourceData, m interface{}) (bool, error) {
 /* ------------------------------------------------------------------------- */
 
 /*
-   This function is called from rsVmExists(), rsVmRead() or rsVmDelete(). It
-   returns the hypervisor host running the VM, its pid and sets "error" if
-   something goes wrong.
+   This function is called from rsSnapExists() or rsSnapRead(). It returns
+   whether "snap_name" exists against "osd_pool"/"img_name", and the error
+   if something goes wrong.
 */
 
-func f_vmExists (name string) (string, int, error) {
-
-  id := fmt.Sprintf ("%s-%s", cfg_vmNamePrefix, name) ;
-  f_log ("searching for : " + id) ;
-
-  ssh_cmd := fmt.Sprintf ("ps axwww -o 'pid args' | grep -v grep | " +
-                          "grep -w '%s' ; /bin/true", id) ;
-  for _, v := range (G_qemu_hosts) {
-
-    /*
-       grab the stdout from the ssh_cmd, a match ought to look like :
+func f_snapExists (osd_pool, img_name, snap_name string) (bool, error) {
 
-        2533650 /usr/local/packages/qemu-4.1.0/bin/qemu-system-x86_64
-        -name tf-helloVm -smp 1 -m 128 -vnc :20 ...
-
-       We expect the PID, "-name" and "id" to be in very specific positions,
-       otherwise return as a negative result.
-    */
+  rbd_cmd := fmt.Sprintf ("rbd snap ls %s/%s", osd_pool, img_name) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  out_buf, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return false, errors.New(fmt.Sprintf("ssh fault - %s", fault)) ;
+  }
+  if (len(err_buf) > 0) {
+    return false, errors.New(fmt.Sprintf("rbd fault - %s", err_buf)) ;
+  }
 
-    stdout, stderr, fault := f_ssh (v, ssh_cmd) ;
-    if (fault != nil) {
-      f_log (fmt.Sprintf ("unable to search %s - %s", v, fault)) ;
-      return "", 0, fault ;
-    }
-    if (len(stderr) > 0) {
-      f_log (fmt.Sprintf ("error on %s - %s", v, stderr)) ;
-      return "", 0, errors.New(stderr) ;
-    }
-    tokens := strings.Fields (stdout) ;
-    if (len(tokens) > 3) {
-      pid, _ := strconv.Atoi (tokens[0]) ;
-      if ((strings.Compare (tokens[2], "-name") == 0) &&
-          (strings.Compare (tokens[3], id) == 0)) {
-        f_log (fmt.Sprintf ("found '%s' on '%s' pid:%d", id, v, pid))
-        return v, pid, nil ;
-      } else {
-        f_log (fmt.Sprintf ("unexpected process [%s]", stdout))
-      }
-    } // ... iterate over one line of "ps" output
-  } // ... iterate over all hypervisor hosts
+  /* each row is "SNAPID NAME SIZE PROTECTED TIMESTAMP" - match NAME exactly */
 
-  f_log (fmt.Sprintf ("vm %s not found", id)) ;
-  return "", 0, nil ;
+  for _, line := range (strings.Split (out_buf, "\n")) {
+    fields := strings.Fields (line) ;
+    if (len(fields) > 1) && (strings.Compare (fields[1], snap_name) == 0) {
+      f_log (fmt.Sprintf ("found '%s/%s@%s'", osd_pool, img_name, snap_name)) ;
+      return true, nil ;
+    }
+  }
+  return false, nil ;
 }
 
-/*
-   This function fires up a VM on the designated hypervisor host. Note that
-   the VM's name is "id", which is "name" prefixed with cfg_vmNamePrefix. This
-   id is returned to terraform to indicate success. If something goes wrong,
-   we don't set "id". This function always returns nil.
-*/
+func rsSnapCreate (d *schema.ResourceData, m interface{}) error {
 
-func rsVmCreate (d *schema.ResourceData, m interface{}) error {
-  vnc := d.Get("vnc").(string) ;
-  mac := d.Get("mac").(string) ;
-  cpus := d.Get("cpus").(int) ;
-  vlan := d.Get("vlan").(int) ;
-  name := d.Get("name").(string) ;
-  mem_mb := d.Get("mem_mb").(int) ;
   osd_pool := d.Get("osd_pool").(string) ;
   img_name := d.Get("img_name").(string) ;
-  f_log (fmt.Sprintf ("name:%s cpus:%d mem_mb:%d vlan:%d vnc:%s img_name:%s",
-                      name, cpus, mem_mb, vlan, vnc, img_name)) ;
-
-  h := f_getHypervisor (mem_mb) ;
-  if (len(h) < 1) {
-    return nil ;
-  }
-  id := cfg_vmNamePrefix + "-" + name ;
+  snap_name := d.Get("snap_name").(string) ;
+  protect := d.Get("protect").(bool) ;
+  f_log (fmt.Sprintf ("%s/%s@%s protect:%t", osd_pool, img_name, snap_name, protect)) ;
 
-  qemu_cmd := fmt.Sprintf ("%s " +
-                           "-name %s " +
-                           "-smp %d " +
-                           "-m %d " +
-                           "-vnc %s " +
-                           "-drive format=rbd,file=rbd:%s/%s," +
-                             "cache=writeback " +
-                           "-nic tap,script=/root/bin/add_tap%d.sh," +
-                             "model=virtio-net-pci,mac=%s " +
-                           "-vga vmware " +
-                           "-enable-kvm " +
-                           "-usb " +
-                           "-device usb-tablet " +
-                           "-daemonize", 
-                           cfg_qemu_sys,
-                           id,
-                           cpus,
-                           mem_mb,
-                           vnc,
-                           osd_pool, img_name,
-                           vlan, mac) ;
-  _, err_buf, fault := f_ssh (h, qemu_cmd)
+  rbd_cmd := fmt.Sprintf ("rbd snap create %s/%s@%s", osd_pool, img_name, snap_name) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
   if (fault != nil) {
-    f_log (fmt.Sprintf ("WARNING: %s", fault)) ;
     return fault ;
   }
   if (len(err_buf) > 0) {
-    return errors.New(err_buf) ;
+    return errors.New (err_buf) ;
   }
 
-  f_log ("returning ID: " + id) ;
-  d.SetId (id) ; /* this indicates success */
-  return nil ;
-}
+  f_log ("returning ID: " + osd_pool + "/" + img_name + "@" + snap_name) ;
+  d.SetId (osd_pool + "/" + img_name + "@" + snap_name) ;	/* this indicates success */
 
-func rsVmRead (d *schema.ResourceData, m interface{}) error {
-  name := d.Get("name").(string) ;
-  f_log ("searching for : " + name) ;
-  hypervisor, _, fault := f_vmExists (name) ;
-  if (fault != nil) && (len(hypervisor) > 0) {
-    d.SetId (cfg_vmNamePrefix + "-" + name) ;   /* this indicates success */
+  if !protect {
+    return nil ;
+  }
+  protect_cmd := fmt.Sprintf ("rbd snap protect %s/%s@%s", osd_pool, img_name, snap_name) ;
+  f_log (fmt.Sprintf ("{%s}", protect_cmd)) ;
+  _, err_buf, fault = f_ssh (G_ceph_hosts[0], protect_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
   }
   return nil ;
 }
 
-func rsVmUpdate (d *schema.ResourceData, m interface{}) error {
-  f_log ("") ;
-  return errors.New ("feature not implemented") ;
-}
+func rsSnapRead (d *schema.ResourceData, m interface{}) error {
 
-/*
-   This function deletes a running VM (ie, kill the qemu process). It returns
-   nil on success, otherwise an error is returned.
-*/
+  osd_pool := d.Get("osd_pool").(string) ;
+  img_name := d.Get("img_name").(string) ;
+  snap_name := d.Get("snap_name").(string) ;
+  f_log (fmt.Sprintf ("%s/%s@%s", osd_pool, img_name, snap_name)) ;
 
-func rsVmDelete (d *schema.ResourceData, m interface{}) error {
-  name := d.Get("name").(string) ;
-  f_log ("deleting VM : " + name) ;
-  hypervisor, pid, fault := f_vmExists (name) ;
-  if (len(hypervisor) > 0) && (pid > 1) && (fault == nil) {
-    ssh_cmd := fmt.Sprintf ("kill %d", pid) ;
-    _, _, fault := f_ssh (hypervisor, ssh_cmd) ;
-    if (fault != nil) {
-      return errors.New (fmt.Sprintf ("Failed to delete %s pid:%d on %s - %s",
-                                      name, pid, hypervisor)) ;
-    } else {
-      return nil ;
-    }
+  result, fault := f_snapExists (osd_pool, img_name, snap_name) ;
+  if (fault == nil) && (result == true) {
+    d.SetId (osd_pool + "/" + img_name + "@" + snap_name) ;	/* this indicates success */
   }
-  return errors.New ("Could not locate VM and pid of " + name)
+  return nil ;
 }
 
 /*
-   This function checks if the requested VM is running in any one of our
-   hypervisor hosts. We look for a VM with "-name" matching what we're looking
-   for. We return a true/false depending on our search, and set "error" if
-   something went wrong.
+   Only "protect" is acted on for an existing snapshot. A change to
+   osd_pool, img_name or snap_name is not applied - no rename or re-point
+   is issued against the existing snapshot.
 */
 
-func rsVmExists (d *schema.ResourceData, m interface{}) (bool, error) {
-  name := d.Get("name").(string) ;
+func rsSnapUpdate (d *schema.ResourceData, m interface{}) error {
+
+  if !d.HasChange ("protect") {
+    return nil ;
+  }
+  osd_pool := d.Get("osd_pool").(string) ;
+  img_name := d.Get("img_name").(string) ;
+  snap_name := d.Get("snap_name").(string) ;
+  _, new_protect := d.GetChange ("protect") ;
+  verb := "unprotect" ;
+  if (new_protect.(bool)) {
+    verb = "protect" ;
+  }
+  f_log (fmt.Sprintf ("%s/%s@%s -> %s", osd_pool, img_name, snap_name, verb)) ;
+
+  rbd_cmd := fmt.Sprintf ("rbd snap %s %s/%s@%s", verb, osd_pool, img_name, snap_name) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+  return nil ;
+}
+
+func rsSnapDelete (d *schema.ResourceData, m interface{}) error {
+
+  osd_pool := d.Get("osd_pool").(string) ;
+  img_name := d.Get("img_name").(string) ;
+  snap_name := d.Get("snap_name").(string) ;
+  protect := d.Get("protect").(bool) ;
+  f_log (fmt.Sprintf ("%s/%s@%s", osd_pool, img_name, snap_name)) ;
+
+  if protect {
+    unprotect_cmd := fmt.Sprintf ("rbd snap unprotect %s/%s@%s", osd_pool, img_name, snap_name) ;
+    f_log (fmt.Sprintf ("{%s}", unprotect_cmd)) ;
+    _, err_buf, fault := f_ssh (G_ceph_hosts[0], unprotect_cmd) ;
+    if (fault != nil) {
+      return fault ;
+    }
+    if (len(err_buf) > 0) {
+      return errors.New (err_buf) ;
+    }
+  }
+
+  rbd_cmd := fmt.Sprintf ("rbd snap rm %s/%s@%s", osd_pool, img_name, snap_name) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+  return nil ;
+}
+
+func rsSnapExists (d *schema.ResourceData, m interface{}) (bool, error) {
+
+  osd_pool := d.Get("osd_pool").(string) ;
+  img_name := d.Get("img_name").(string) ;
+  snap_name := d.Get("snap_name").(string) ;
+  f_log (fmt.Sprintf ("%s/%s@%s", osd_pool, img_name, snap_name)) ;
+
+  return f_snapExists (osd_pool, img_name, snap_name) ;
+}
+
+/* ------------------------------------------------------------------------- */
+
+/*
+   rbdqemu_clone creates a writable child image by cloning a protected
+   parent snapshot (rbdqemu_snapshot with protect=true). Deleting the clone
+   only removes the child image - the parent snapshot is left alone, since
+   it may be shared by other clones.
+*/
+
+func rsCloneCreate (d *schema.ResourceData, m interface{}) error {
+
+  parent_pool := d.Get("parent_pool").(string) ;
+  parent_img := d.Get("parent_img").(string) ;
+  parent_snap := d.Get("parent_snap").(string) ;
+  child_pool := d.Get("child_pool").(string) ;
+  child_img := d.Get("child_img").(string) ;
+  f_log (fmt.Sprintf ("%s/%s@%s -> %s/%s",
+                      parent_pool, parent_img, parent_snap, child_pool, child_img)) ;
+
+  rbd_cmd := fmt.Sprintf ("rbd clone %s/%s@%s %s/%s",
+                          parent_pool, parent_img, parent_snap, child_pool, child_img) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+
+  f_log ("returning ID: " + child_pool + "/" + child_img) ;
+  d.SetId (child_pool + "/" + child_img) ;	/* this indicates success */
+  return nil ;
+}
+
+func rsCloneRead (d *schema.ResourceData, m interface{}) error {
+
+  child_pool := d.Get("child_pool").(string) ;
+  child_img := d.Get("child_img").(string) ;
+  f_log (fmt.Sprintf ("%s/%s", child_pool, child_img)) ;
+
+  result, fault := f_rbdExists (child_pool, child_img) ;
+  if (fault == nil) && (result == true) {
+    d.SetId (child_pool + "/" + child_img) ;	/* this indicates success */
+  }
+  return nil ;
+}
+
+func rsCloneUpdate (d *schema.ResourceData, m interface{}) error {
+  f_log ("") ;
+  return errors.New ("feature not implemented") ;
+}
+
+func rsCloneDelete (d *schema.ResourceData, m interface{}) error {
+
+  child_pool := d.Get("child_pool").(string) ;
+  child_img := d.Get("child_img").(string) ;
+  f_log (fmt.Sprintf ("%s/%s", child_pool, child_img)) ;
+
+  rbd_cmd := fmt.Sprintf ("rbd rm --no-progress %s/%s", child_pool, child_img) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+  return nil ;
+}
+
+func rsCloneExists (d *schema.ResourceData, m interface{}) (bool, error) {
+
+  child_pool := d.Get("child_pool").(string) ;
+  child_img := d.Get("child_img").(string) ;
+  f_log (fmt.Sprintf ("%s/%s", child_pool, child_img)) ;
+
+  return f_rbdExists (child_pool, child_img) ;
+}
+
+/* ------------------------------------------------------------------------- */
+
+/*
+   This is the on-disk record written to "<cfg_vm_state_dir>/<id>.json" on a
+   VM's hypervisor when it's created. It replaces grepping "ps" output for
+   every terraform operation - f_vmExists() below reads this instead, and
+   only falls back to QMP to confirm the process it names is still alive.
+*/
+
+type vmState struct {
+  Pid int `json:"pid"` ;
+  QmpSocket string `json:"qmp_socket"` ;
+  Pidfile string `json:"pidfile"` ;
+  ChosenHost string `json:"chosen_host"` ;
+  CreatedAt string `json:"created_at"` ;
+  ConfigHash string `json:"config_hash"` ;
+  Disks []diskConfig `json:"disks"` ;
+  DimmCount int `json:"dimm_count"` ;
+  FsPids []int `json:"fs_pids"` ;
+}
+
+func f_vmStatePath (id string) string {
+  return fmt.Sprintf ("%s/%s.json", cfg_vm_state_dir, id) ;
+}
+
+func f_pidfilePath (id string) string {
+  return fmt.Sprintf ("%s/%s.pid", cfg_qemu_qmp_dir, id) ;
+}
+
+func f_fsPidfilePath (id string, i int) string {
+  return fmt.Sprintf ("%s/%s-fs%d.pid", cfg_qemu_qmp_dir, id, i) ;
+}
+
+/*
+   This function reads back the pids of the "n_fs" virtiofsd sidecars
+   spawned for "id" on "host" (see f_qemuLaunchCmd), for persisting into
+   vmState.FsPids. A sidecar whose pidfile can't be read is logged and
+   skipped rather than failing the whole VM launch.
+*/
+
+func f_readFsPids (host, id string, n_fs int) []int {
+  var pids []int ;
+  for i := 0; i < n_fs; i++ {
+    pid_buf, _, fault := f_ssh (host, fmt.Sprintf ("cat %s", f_fsPidfilePath (id, i))) ;
+    if (fault != nil) {
+      f_log (fmt.Sprintf ("WARNING: cannot read fs%d pidfile for %s - %s", i, id, fault)) ;
+      continue ;
+    }
+    pid, _ := strconv.Atoi (strings.TrimSpace (pid_buf)) ;
+    if (pid > 1) {
+      pids = append (pids, pid) ;
+    }
+  }
+  return pids ;
+}
+
+/*
+   This function hashes a vmConfig so we can tell, at a glance, whether a
+   running VM's devices still match what terraform thinks it asked for.
+*/
+
+func f_configHash (cfg vmConfig) string {
+  buf, err := json.Marshal (cfg) ;
+  if (err != nil) {
+    f_log (fmt.Sprintf ("WARNING: Cannot marshal vmConfig - %s", err)) ;
+    return "" ;
+  }
+  sum := sha256.Sum256 (buf) ;
+  return fmt.Sprintf ("%x", sum) ;
+}
+
+/*
+   This function writes "state" to "<cfg_vm_state_dir>/<id>.json" on "host".
+*/
+
+func f_writeVmState (host, id string, state vmState) error {
+  buf, err := json.Marshal (state) ;
+  if (err != nil) {
+    return err ;
+  }
+  ssh_cmd := fmt.Sprintf ("mkdir -p %s && echo '%s' > %s",
+                          cfg_vm_state_dir, string(buf), f_vmStatePath (id)) ;
+  f_log (fmt.Sprintf ("{%s}", ssh_cmd)) ;
+  _, err_buf, fault := f_ssh (host, ssh_cmd) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+  return nil ;
+}
+
+/*
+   This function reads back the vmState written by f_writeVmState() above.
+   It returns an error if "host" is unreachable or has no state file for
+   "id" - either way, the caller should move on to the next hypervisor.
+*/
+
+func f_readVmState (host, id string) (vmState, error) {
+  var state vmState ;
+  out_buf, _, fault := f_ssh (host, fmt.Sprintf ("cat %s 2>/dev/null", f_vmStatePath (id))) ;
+  if (fault != nil) {
+    return state, fault ;
+  }
+  if (len(out_buf) == 0) {
+    return state, errors.New ("no state file on " + host) ;
+  }
+  if err := json.Unmarshal ([]byte(out_buf), &state); err != nil {
+    return state, err ;
+  }
+  return state, nil ;
+}
+
+/*
+   This function confirms a VM is actually still running, rather than
+   trusting a stale state file, by issuing a QMP "query-status" over its
+   control socket. Any failure - stale/missing socket, unreachable host -
+   is treated as "not alive" rather than a hard error.
+*/
+
+func f_vmAlive (host, sock string) bool {
+  reply, fault := f_qmpCommand (host, sock, f_qmpBuild ("query-status", nil)) ;
+  if (fault != nil) {
+    f_log (fmt.Sprintf ("WARNING: query-status on %s - %s", host, fault)) ;
+    return false ;
+  }
+  return strings.Contains (reply, `"return"`) ;
+}
+
+/*
+   These maintain an optional, controller-local cache mapping VM id ->
+   hypervisor host, at the path given by the provider's "vm_index_cache"
+   option. It's a pure optimization: on a cache hit, f_vmExists() can
+   confirm liveness by ssh'ing to that one host (to read its state file,
+   then to query QMP) instead of scanning every hypervisor. A missing/stale cache just falls back to scanning.
+
+   terraform-plugin-sdk can run multiple rbdqemu_vm Create/Read/Update/
+   Delete calls concurrently (apply parallelism defaults to 10), so
+   G_vm_index is live mutable state shared across goroutines, not just a
+   single-threaded cache - every access goes through G_vm_index_mu below,
+   and f_vmIndexLookup()/f_vmIndexSet()/f_vmIndexDelete() are the only
+   entry points the rest of the provider should use to touch it.
+*/
+
+func f_loadVmIndexLocked () {
+  if (G_vm_index != nil) {
+    return ;
+  }
+  G_vm_index = map[string] string {} ;
+  if (len(G_vm_index_cache) == 0) {
+    return ;
+  }
+  buf, err := os.ReadFile (G_vm_index_cache) ;
+  if (err != nil) {
+    return ;
+  }
+  json.Unmarshal (buf, &G_vm_index) ;
+}
+
+func f_saveVmIndexLocked () {
+  if (len(G_vm_index_cache) == 0) {
+    return ;
+  }
+  buf, err := json.Marshal (G_vm_index) ;
+  if (err != nil) {
+    f_log (fmt.Sprintf ("WARNING: Cannot marshal vm_index - %s", err)) ;
+    return ;
+  }
+  if err := os.WriteFile (G_vm_index_cache, buf, 0644); err != nil {
+    f_log (fmt.Sprintf ("WARNING: Cannot write %s - %s", G_vm_index_cache, err)) ;
+  }
+}
+
+func f_vmIndexLookup (id string) (string, bool) {
+  G_vm_index_mu.Lock () ;
+  defer G_vm_index_mu.Unlock () ;
+  f_loadVmIndexLocked () ;
+  host, ok := G_vm_index[id] ;
+  return host, ok ;
+}
+
+func f_vmIndexSet (id, host string) {
+  G_vm_index_mu.Lock () ;
+  defer G_vm_index_mu.Unlock () ;
+  f_loadVmIndexLocked () ;
+  G_vm_index[id] = host ;
+  f_saveVmIndexLocked () ;
+}
+
+func f_vmIndexDelete (id string) {
+  G_vm_index_mu.Lock () ;
+  defer G_vm_index_mu.Unlock () ;
+  f_loadVmIndexLocked () ;
+  delete (G_vm_index, id) ;
+  f_saveVmIndexLocked () ;
+}
+
+/*
+   This function is called from rsVmExists(), rsVmRead() or rsVmDelete(). It
+   returns the hypervisor host running the VM, its pid and sets "error" if
+   something goes wrong. It first consults the cached vm->host index, then
+   falls back to scanning every hypervisor's state file, confirming
+   liveness with QMP rather than parsing "ps" output.
+*/
+
+func f_vmExists (name string) (string, int, error) {
+
+  id := fmt.Sprintf ("%s-%s", cfg_vmNamePrefix, name) ;
+  f_log ("searching for : " + id) ;
+
+  if host, ok := f_vmIndexLookup (id); ok {
+    state, fault := f_readVmState (host, id) ;
+    if (fault == nil) && f_vmAlive (host, state.QmpSocket) {
+      f_log (fmt.Sprintf ("found '%s' on '%s' (cached) pid:%d", id, host, state.Pid)) ;
+      return host, state.Pid, nil ;
+    }
+    f_vmIndexDelete (id) ;
+  }
+
+  for _, v := range (G_qemu_hosts) {
+    state, fault := f_readVmState (v, id) ;
+    if (fault != nil) {
+      continue ; /* no state file here, or host unreachable - try the next one */
+    }
+    if !f_vmAlive (v, state.QmpSocket) {
+      continue ;
+    }
+    f_log (fmt.Sprintf ("found '%s' on '%s' pid:%d", id, v, state.Pid)) ;
+    f_vmIndexSet (id, v) ;
+    return v, state.Pid, nil ;
+  }
+
+  f_log (fmt.Sprintf ("vm %s not found", id)) ;
+  return "", 0, nil ;
+}
+
+/*
+   This function returns the path of the QMP control socket for VM "id" on
+   its hypervisor. qemu is launched with "-qmp unix:<path>,server,nowait" so
+   that f_qmpCommand() below can talk to it.
+*/
+
+func f_qmpSockPath (id string) string {
+  return fmt.Sprintf ("%s/%s.sock", cfg_qemu_qmp_dir, id) ;
+}
+
+/*
+   This is a small helper to build a single QMP "execute" command, with
+   optional "arguments", marshalled to JSON on one line.
+*/
+
+func f_qmpBuild (execute string, args map[string] interface{}) string {
+  cmd := map[string] interface{} { "execute": execute } ;
+  if (args != nil) {
+    cmd["arguments"] = args ;
+  }
+  buf, err := json.Marshal (cmd) ;
+  if (err != nil) {
+    f_log (fmt.Sprintf ("WARNING: Cannot marshal %v - %s", cmd, err)) ;
+    return "" ;
+  }
+  return string (buf) ;
+}
+
+/*
+   This function issues one or more QMP commands against the QMP socket
+   "sock" on "host". The socket only exists on the hypervisor itself, so we
+   can't dial it directly - instead we pipe the QMP JSON through "socat"
+   over ssh, same as how every other remote operation in this provider
+   works. The mandatory "qmp_capabilities" handshake is prefixed ahead of
+   whatever commands the caller supplies. It returns the raw QMP replies
+   (one JSON object per line) and sets "error" if something goes wrong.
+*/
+
+func f_qmpCommand (host, sock string, cmds ...string) (string, error) {
+
+  all := append ([]string { `{"execute":"qmp_capabilities"}` }, cmds...) ;
+  payload := strings.Join (all, "\n") ;
+  qmp_cmd := fmt.Sprintf ("echo '%s' | socat - UNIX-CONNECT:%s", payload, sock) ;
+  f_log (fmt.Sprintf ("{%s}", qmp_cmd)) ;
+  out_buf, err_buf, fault := f_ssh (host, qmp_cmd) ;
+  if (fault != nil) {
+    return "", fault ;
+  }
+  if (len(err_buf) > 0) {
+    return "", errors.New (err_buf) ;
+  }
+  return out_buf, nil ;
+}
+
+/*
+   These types mirror the repeatable "disk"/"nic"/"fs"/"pmem" blocks in
+   vmItem()'s schema, one entry per device the VM should be launched with.
+   This replaces the old flat osd_pool/img_name/vlan/mac fields, which could
+   only ever describe a single disk and a single NIC.
+*/
+
+type diskConfig struct {
+  OsdPool string ;
+  ImgName string ;
+  Cache string ;
+}
+
+type nicConfig struct {
+  Vlan int ;
+  Mac string ;
+}
+
+type virtioFsConfig struct {
+  HostPath string ;
+  MountTag string ;
+}
+
+type pmemConfig struct {
+  OsdPool string ;
+  ImgName string ;
+  SizeMb int ;
+}
+
+type vmConfig struct {
+  Disks []diskConfig ;
+  Nics []nicConfig ;
+  Fs []virtioFsConfig ;
+  Pmem []pmemConfig ;
+}
+
+/*
+   This function reads the "disk"/"nic"/"fs"/"pmem" blocks out of "d" and
+   returns them as a vmConfig.
+*/
+
+func f_readVmConfig (d *schema.ResourceData) vmConfig {
+
+  var cfg vmConfig ;
+
+  for _, v := range (d.Get("disk").([]interface{})) {
+    m := v.(map[string] interface{}) ;
+    cfg.Disks = append (cfg.Disks, diskConfig {
+      OsdPool: m["osd_pool"].(string),
+      ImgName: m["img_name"].(string),
+      Cache: m["cache"].(string),
+    }) ;
+  }
+  for _, v := range (d.Get("nic").([]interface{})) {
+    m := v.(map[string] interface{}) ;
+    cfg.Nics = append (cfg.Nics, nicConfig {
+      Vlan: m["vlan"].(int),
+      Mac: m["mac"].(string),
+    }) ;
+  }
+  for _, v := range (d.Get("fs").([]interface{})) {
+    m := v.(map[string] interface{}) ;
+    cfg.Fs = append (cfg.Fs, virtioFsConfig {
+      HostPath: m["host_path"].(string),
+      MountTag: m["mount_tag"].(string),
+    }) ;
+  }
+  for _, v := range (d.Get("pmem").([]interface{})) {
+    m := v.(map[string] interface{}) ;
+    cfg.Pmem = append (cfg.Pmem, pmemConfig {
+      OsdPool: m["osd_pool"].(string),
+      ImgName: m["img_name"].(string),
+      SizeMb: m["size_mb"].(int),
+    }) ;
+  }
+  return cfg ;
+}
+
+/*
+   This function returns the name of the seed RBD image that should be
+   attached to VM "id" as a cdrom, or "" if the VM has no "cloud_init"
+   block configured. It's pure - it never touches the network - so that
+   f_qemuLaunchCmd() can call it on every launch, including a migration
+   target, without redoing the (idempotent, but not free) seed import.
+*/
+
+func f_seedImgName (d *schema.ResourceData, id string) string {
+  if (len (d.Get("cloud_init").([]interface{})) == 0) {
+    return "" ;
+  }
+  return id + "-seed" ;
+}
+
+/*
+   This function renders a NoCloud seed ISO from the VM's "cloud_init"
+   block (if any) and imports it as "<id>-seed" into the provider's
+   "seed_pool", so rsVmCreate() can attach it as a read-only cdrom. It's a
+   no-op if the VM has no "cloud_init" block.
+*/
+
+func f_createCloudInitSeed (d *schema.ResourceData, id string) error {
+
+  list := d.Get("cloud_init").([]interface{}) ;
+  if (len(list) == 0) {
+    return nil ;
+  }
+  ci := list[0].(map[string] interface{}) ;
+  user_data := ci["user_data"].(string) ;
+  meta_data := ci["meta_data"].(string) ;
+  network_config := ci["network_config"].(string) ;
+  hostname := ci["hostname"].(string) ;
+
+  if (len(meta_data) == 0) {
+    meta_data = fmt.Sprintf ("instance-id: %s\nlocal-hostname: %s\n", id, hostname) ;
+  }
+
+  files := map[string] []byte {
+    "user-data": []byte (user_data),
+    "meta-data": []byte (meta_data),
+  } ;
+  if (len(network_config) > 0) {
+    files["network-config"] = []byte (network_config) ;
+  }
+
+  iso, err := f_buildNoCloudISO (files) ;
+  if (err != nil) {
+    return err ;
+  }
+
+  seed_img := f_seedImgName (d, id) ;
+  rbd_cmd := fmt.Sprintf ("rbd import --pool %s --image %s -", G_seed_pool, seed_img) ;
+  f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+  _, err_buf, fault := f_sshStdin (G_ceph_hosts[0], rbd_cmd, iso) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+  return nil ;
+}
+
+/*
+   This function builds the qemu command line for VM "id" from the resource
+   data in "d". "extra" is appended verbatim just before "-daemonize", so
+   callers can bolt on launch-time-only flags (eg "-incoming tcp:0:<port>"
+   for a migration target) without duplicating the rest of the command.
+*/
+
+func f_qemuLaunchCmd (d *schema.ResourceData, cfg vmConfig, id, host, extra string) (string, error) {
+  vnc := d.Get("vnc").(string) ;
+  cpus := d.Get("cpus").(int) ;
+  mem_mb := d.Get("mem_mb").(int) ;
+  max_cpus := d.Get("max_cpus").(int) ;
+  mem_slots := d.Get("mem_slots").(int) ;
+  max_mem_mb := d.Get("max_mem_mb").(int) ;
+
+  /*
+     "maxcpus"/"slots"+"maxmem" reserve hotplug headroom at boot - qemu
+     rejects cpu-add beyond "cpus" without the former, and device_add
+     pc-dimm beyond "mem_mb" without the latter (see rsVmUpdate()).
+  */
+
+  qemu_cmd := fmt.Sprintf ("%s -name %s -smp %d,maxcpus=%d " +
+                           "-m %d,slots=%d,maxmem=%dM -vnc %s " +
+                           "-qmp unix:%s,server,nowait -pidfile %s ",
+                           cfg_qemu_sys, id, cpus, max_cpus,
+                           mem_mb, mem_slots, max_mem_mb, vnc,
+                           f_qmpSockPath (id), f_pidfilePath (id)) ;
+
+  for i, disk := range (cfg.Disks) {
+    boot := "" ;
+    if (i == 0) {
+      boot = ",bootindex=1" ;
+    }
+    qemu_cmd += fmt.Sprintf ("-drive id=%s,format=rbd,file=rbd:%s/%s,cache=%s%s ",
+                             f_diskDriveId (i), disk.OsdPool, disk.ImgName, disk.Cache, boot) ;
+  }
+
+  seed_img := f_seedImgName (d, id) ;
+  if (len(seed_img) > 0) {
+    qemu_cmd += fmt.Sprintf ("-drive format=rbd,file=rbd:%s/%s,media=cdrom,readonly=on ",
+                             G_seed_pool, seed_img) ;
+  }
+
+  for i, nic := range (cfg.Nics) {
+    netdev_id := fmt.Sprintf ("netdev%d", i) ;
+    dev_id := fmt.Sprintf ("net%d", i) ;
+    qemu_cmd += fmt.Sprintf ("-netdev tap,id=%s,script=/root/bin/add_tap%d.sh " +
+                             "-device virtio-net-pci,netdev=%s,mac=%s,id=%s ",
+                             netdev_id, nic.Vlan, netdev_id, nic.Mac, dev_id) ;
+  }
+
+  /*
+     virtio-fs needs a virtiofsd sidecar per shared directory, talking to
+     qemu over a unix socket, plus shared guest memory so the daemon can
+     map pages directly into the guest's address space. Its pid is
+     captured to a pidfile (f_fsPidfilePath) so rsVmCreate/f_migrateVm can
+     record it in vmState.FsPids and rsVmDelete can reap it alongside qemu.
+  */
+
+  for i, fs := range (cfg.Fs) {
+    sock := fmt.Sprintf ("%s/%s-fs%d.sock", cfg_qemu_qmp_dir, id, i) ;
+    virtiofsd_cmd := fmt.Sprintf ("virtiofsd --socket-path=%s -o source=%s & echo $! > %s",
+                                  sock, fs.HostPath, f_fsPidfilePath (id, i)) ;
+    f_log (fmt.Sprintf ("{%s}", virtiofsd_cmd)) ;
+    _, err_buf, fault := f_ssh (host, virtiofsd_cmd) ;
+    if (fault != nil) {
+      return "", fault ;
+    }
+    if (len(err_buf) > 0) {
+      return "", errors.New (err_buf) ;
+    }
+    chardev_id := fmt.Sprintf ("fschar%d", i) ;
+    qemu_cmd += fmt.Sprintf ("-chardev socket,id=%s,path=%s " +
+                             "-device vhost-user-fs-pci,chardev=%s,tag=%s ",
+                             chardev_id, sock, chardev_id, fs.MountTag) ;
+  }
+  if (len(cfg.Fs) > 0) {
+    qemu_cmd += fmt.Sprintf ("-object memory-backend-memfd,id=vfsmem,size=%dM,share=on " +
+                             "-numa node,memdev=vfsmem ", mem_mb) ;
+  }
+
+  for i, pmem := range (cfg.Pmem) {
+    obj_id := fmt.Sprintf ("pmem%d", i) ;
+    qemu_cmd += fmt.Sprintf ("-object memory-backend-file,id=%s,share=on," +
+                             "mem-path=rbd:%s/%s,size=%dM " +
+                             "-device nvdimm,id=nvdimm%d,memdev=%s ",
+                             obj_id, pmem.OsdPool, pmem.ImgName, pmem.SizeMb, i, obj_id) ;
+  }
+
+  qemu_cmd += fmt.Sprintf ("-vga vmware -enable-kvm -usb -device usb-tablet %s -daemonize",
+                           extra) ;
+  return qemu_cmd, nil ;
+}
+
+/*
+   This function fires up a VM on the designated hypervisor host. Note that
+   the VM's name is "id", which is "name" prefixed with cfg_vmNamePrefix. This
+   id is returned to terraform to indicate success. If something goes wrong,
+   we don't set "id" and the error is returned - except when no hypervisor
+   could be picked, where nil is returned with "id" left unset.
+*/
+
+func rsVmCreate (d *schema.ResourceData, m interface{}) error {
+  name := d.Get("name").(string) ;
+  cpus := d.Get("cpus").(int) ;
+  mem_mb := d.Get("mem_mb").(int) ;
+  target_host := d.Get("target_host").(string) ;
+  cfg := f_readVmConfig (d) ;
+  f_log (fmt.Sprintf ("name:%s cpus:%d mem_mb:%d vnc:%s disks:%d nics:%d fs:%d pmem:%d",
+                      name, cpus, mem_mb, d.Get("vnc").(string),
+                      len(cfg.Disks), len(cfg.Nics), len(cfg.Fs), len(cfg.Pmem))) ;
+
+  h := f_getHypervisor (mem_mb, cpus, target_host) ;
+  if (len(h) < 1) {
+    return nil ;
+  }
+  id := cfg_vmNamePrefix + "-" + name ;
+
+  if fault := f_createCloudInitSeed (d, id); fault != nil {
+    f_log (fmt.Sprintf ("WARNING: cannot create cloud-init seed for %s - %s", id, fault)) ;
+    return fault ;
+  }
+
+  qemu_cmd, fault := f_qemuLaunchCmd (d, cfg, id, h, "") ;
+  if (fault != nil) {
+    return fault ;
+  }
+  _, err_buf, fault := f_sshLocked (h, qemu_cmd, mem_mb, cpus)
+  if (fault != nil) {
+    f_log (fmt.Sprintf ("WARNING: %s", fault)) ;
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New(err_buf) ;
+  }
+
+  /* record this VM in the state registry so f_vmExists() can find it again */
+
+  pid_buf, _, fault := f_ssh (h, fmt.Sprintf ("cat %s", f_pidfilePath (id))) ;
+  if (fault != nil) {
+    f_log (fmt.Sprintf ("WARNING: cannot read pidfile for %s - %s", id, fault)) ;
+  }
+  pid, _ := strconv.Atoi (strings.TrimSpace (pid_buf)) ;
+  fs_pids := f_readFsPids (h, id, len(cfg.Fs)) ;
+  state := vmState {
+    Pid: pid,
+    QmpSocket: f_qmpSockPath (id),
+    Pidfile: f_pidfilePath (id),
+    ChosenHost: h,
+    CreatedAt: time.Now().Format (time.RFC3339),
+    ConfigHash: f_configHash (cfg),
+    Disks: cfg.Disks,
+    FsPids: fs_pids,
+  } ;
+  if fault := f_writeVmState (h, id, state); fault != nil {
+    f_log (fmt.Sprintf ("WARNING: cannot write state for %s - %s", id, fault)) ;
+  }
+  f_vmIndexSet (id, h) ;
+
+  f_log ("returning ID: " + id) ;
+  d.SetId (id) ; /* this indicates success */
+  return nil ;
+}
+
+func rsVmRead (d *schema.ResourceData, m interface{}) error {
+  name := d.Get("name").(string) ;
+  f_log ("searching for : " + name) ;
+  hypervisor, _, fault := f_vmExists (name) ;
+  if (fault != nil) && (len(hypervisor) > 0) {
+    d.SetId (cfg_vmNamePrefix + "-" + name) ;   /* this indicates success */
+  }
+  return nil ;
+}
+
+/*
+   This function live-migrates VM "name" from hypervisor "src" to "dst". It
+   launches a paused, incoming qemu on "dst" (same command line as a normal
+   create, via f_qemuLaunchCmd), tunes bandwidth/downtime on the source via
+   QMP "migrate-set-parameters", then triggers "migrate" over tcp. Since
+   both hypervisors share the same Ceph RBD backing, only RAM/CPU state has
+   to cross the wire - no disk copy is required. It polls "query-migrate"
+   on the source until the migration completes, then kills the source qemu.
+   It returns nil on success, otherwise an error is returned.
+*/
+
+func f_migrateVm (d *schema.ResourceData, name, src, dst string) error {
+
+  id := cfg_vmNamePrefix + "-" + name ;
+  sock := f_qmpSockPath (id) ;
+  f_log (fmt.Sprintf ("migrating %s from %s to %s", id, src, dst)) ;
+
+  hypervisor, pid, fault := f_vmExists (name) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (strings.Compare (hypervisor, src) != 0) {
+    return errors.New (fmt.Sprintf ("%s is not running on %s", id, src)) ;
+  }
+
+  extra := fmt.Sprintf ("-incoming tcp:0:%d", cfg_qemu_migrate_port) ;
+  dst_cmd, fault := f_qemuLaunchCmd (d, f_readVmConfig (d), id, dst, extra) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  _, err_buf, fault := f_sshLocked (dst, dst_cmd, d.Get("mem_mb").(int), d.Get("cpus").(int)) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(err_buf) > 0) {
+    return errors.New (err_buf) ;
+  }
+
+  _, fault = f_qmpCommand (src, sock, f_qmpBuild ("migrate-set-parameters",
+                           map[string] interface{} {
+                             "max-bandwidth": G_migrate_max_bandwidth_mbps * 1024 * 1024,
+                             "downtime-limit": G_migrate_max_downtime_ms,
+                           })) ;
+  if (fault != nil) {
+    return fault ;
+  }
+
+  migrate_uri := fmt.Sprintf ("tcp:%s:%d", dst, cfg_qemu_migrate_port) ;
+  _, fault = f_qmpCommand (src, sock, f_qmpBuild ("migrate",
+                           map[string] interface{} { "uri": migrate_uri })) ;
+  if (fault != nil) {
+    return fault ;
+  }
+
+  for i := 0; i < cfg_migrate_poll_tries; i++ {
+    time.Sleep (cfg_migrate_poll_interval) ;
+    reply, fault := f_qmpCommand (src, sock, f_qmpBuild ("query-migrate", nil)) ;
+    if (fault != nil) {
+      return fault ;
+    }
+    f_log ("query-migrate: " + reply) ;
+    if (strings.Contains (reply, `"status": "completed"`)) {
+      _, _, fault := f_ssh (src, fmt.Sprintf ("kill %d", pid)) ;
+      if (fault != nil) {
+        return fault ;
+      }
+
+      /* the old virtiofsd sidecars on "src" don't migrate with the guest -
+         f_qemuLaunchCmd already spawned fresh ones on "dst" above, so the
+         src-side pids recorded in the old state are now orphans */
+
+      if src_state, fault := f_readVmState (src, id); fault == nil {
+        for _, fs_pid := range (src_state.FsPids) {
+          f_ssh (src, fmt.Sprintf ("kill %d", fs_pid)) ;
+        }
+      }
+
+      /* move the state registry entry over to "dst" */
+
+      f_ssh (src, fmt.Sprintf ("rm -f %s", f_vmStatePath (id))) ;
+      dst_pid_buf, _, fault := f_ssh (dst, fmt.Sprintf ("cat %s", f_pidfilePath (id))) ;
+      if (fault != nil) {
+        f_log (fmt.Sprintf ("WARNING: cannot read pidfile for %s on %s - %s", id, dst, fault)) ;
+      }
+      dst_pid, _ := strconv.Atoi (strings.TrimSpace (dst_pid_buf)) ;
+      dst_cfg := f_readVmConfig (d) ;
+      state := vmState {
+        Pid: dst_pid,
+        QmpSocket: sock,
+        Pidfile: f_pidfilePath (id),
+        ChosenHost: dst,
+        CreatedAt: time.Now().Format (time.RFC3339),
+        ConfigHash: f_configHash (dst_cfg),
+        Disks: dst_cfg.Disks,
+        FsPids: f_readFsPids (dst, id, len(dst_cfg.Fs)),
+      } ;
+      if fault := f_writeVmState (dst, id, state); fault != nil {
+        f_log (fmt.Sprintf ("WARNING: cannot write state for %s on %s - %s", id, dst, fault)) ;
+      }
+      f_vmIndexSet (id, dst) ;
+
+      f_log (fmt.Sprintf ("migration of %s to %s complete", id, dst)) ;
+      return nil ;
+    }
+  }
+  return errors.New (fmt.Sprintf ("migration of %s to %s timed out", id, dst)) ;
+}
+
+/*
+   This function mutates a running VM in place via QMP, instead of forcing
+   terraform to destroy and recreate it. If "allow_migrate" is set and a
+   better-balanced hypervisor is available (or "preferred_host" changed),
+   the VM is live-migrated there first via f_migrateVm. The "disk", "fs",
+   "pmem" and "cloud_init" blocks can't be swapped out from under a running
+   guest, so any change to them - or to the number of "nic" blocks - falls
+   back to a stop/relaunch. Everything else - cpus, mem_mb, vnc, each nic's
+   vlan/mac - is applied live over the VM's QMP socket; growing cpus or
+   mem_mb is hot-added, while shrinking either is logged and ignored. It
+   returns nil on success, otherwise an error is returned.
+*/
+
+func rsVmUpdate (d *schema.ResourceData, m interface{}) error {
+
+  name := d.Get("name").(string) ;
+  f_log ("updating VM : " + name) ;
+
+  hypervisor, _, fault := f_vmExists (name) ;
+  if (fault != nil) {
+    return fault ;
+  }
+  if (len(hypervisor) < 1) {
+    return errors.New ("Could not locate VM " + name) ;
+  }
+  id := cfg_vmNamePrefix + "-" + name ;
+  sock := f_qmpSockPath (id) ;
+
+  if d.Get("allow_migrate").(bool) {
+    var want_host string ;
+    preferred := d.Get("preferred_host").(string) ;
+    if d.HasChange("preferred_host") && (len(preferred) > 0) {
+      want_host = preferred ;
+    } else {
+      want_host = f_getHypervisor (d.Get("mem_mb").(int), d.Get("cpus").(int), "") ;
+    }
+    if (len(want_host) > 0) && (strings.Compare (want_host, hypervisor) != 0) {
+      if fault := f_migrateVm (d, name, hypervisor, want_host); fault != nil {
+        return fault ;
+      }
+      hypervisor = want_host ;
+    }
+  }
+
+  if d.HasChange("disk") || d.HasChange("fs") || d.HasChange("pmem") || d.HasChange("cloud_init") {
+    f_log ("disk/fs/pmem/cloud_init changed, falling back to stop/relaunch") ;
+    if fault := rsVmDelete (d, m); fault != nil {
+      return fault ;
+    }
+    return rsVmCreate (d, m) ;
+  }
+
+  if d.HasChange("cpus") {
+    old_cpus, new_cpus := d.GetChange("cpus") ;
+    o, n := old_cpus.(int), new_cpus.(int) ;
+    f_log (fmt.Sprintf ("cpus %d -> %d", o, n)) ;
+    if (n < o) {
+      f_log ("WARNING: qemu cannot hot-unplug vcpus, ignoring shrink") ;
+    } else {
+      reply, fault := f_qmpCommand (hypervisor, sock, f_qmpBuild ("query-cpus", nil)) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      f_log ("query-cpus: " + reply) ;
+      for i := o; i < n; i++ {
+        _, fault = f_qmpCommand (hypervisor, sock,
+                                 f_qmpBuild ("cpu-add", map[string] interface{} { "id": i })) ;
+        if (fault != nil) {
+          return fault ;
+        }
+      }
+    }
+  }
+
+  if d.HasChange("mem_mb") {
+    old_mem, new_mem := d.GetChange("mem_mb") ;
+    o, n := old_mem.(int), new_mem.(int) ;
+    f_log (fmt.Sprintf ("mem_mb %d -> %d", o, n)) ;
+    if (n < o) {
+      f_log ("WARNING: qemu cannot hot-unplug memory, ignoring shrink") ;
+    } else {
+
+      /* every hot-add needs a QOM id qemu hasn't already seen on this
+         instance, so the count is persisted in vmState and bumped each
+         time - reusing "dimm-"+id/"mem-"+id would collide on a VM's
+         second mem_mb increase. */
+
+      state, fault := f_readVmState (hypervisor, id) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      state.DimmCount++ ;
+      dimm_size_mb := n - o ;
+      dimm_id := fmt.Sprintf ("dimm-%s-%d", id, state.DimmCount) ;
+      mem_id := fmt.Sprintf ("mem-%s-%d", id, state.DimmCount) ;
+      _, fault = f_qmpCommand (hypervisor, sock,
+                               f_qmpBuild ("object-add", map[string] interface{} {
+                                 "qom-type": "memory-backend-ram",
+                                 "id": mem_id,
+                                 "props": map[string] interface{} {
+                                   "size": dimm_size_mb * 1024 * 1024,
+                                 },
+                               })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      _, fault = f_qmpCommand (hypervisor, sock,
+                               f_qmpBuild ("device_add", map[string] interface{} {
+                                 "driver": "pc-dimm",
+                                 "id": dimm_id,
+                                 "memdev": mem_id,
+                               })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      if fault := f_writeVmState (hypervisor, id, state); fault != nil {
+        f_log (fmt.Sprintf ("WARNING: cannot persist dimm_count for %s - %s", id, fault)) ;
+      }
+    }
+  }
+
+  if d.HasChange("vnc") {
+    _, new_vnc := d.GetChange("vnc") ;
+    f_log ("vnc -> " + new_vnc.(string)) ;
+    _, fault = f_qmpCommand (hypervisor, sock,
+                             f_qmpBuild ("change", map[string] interface{} {
+                               "device": "vnc",
+                               "target": new_vnc.(string),
+                             })) ;
+    if (fault != nil) {
+      return fault ;
+    }
+  }
+
+  if d.HasChange("nic") {
+    old_nics, new_nics := d.GetChange("nic") ;
+    o := old_nics.([]interface{}) ;
+    n := new_nics.([]interface{}) ;
+    if (len(o) != len(n)) {
+      f_log ("nic count changed, falling back to stop/relaunch") ;
+      if fault := rsVmDelete (d, m); fault != nil {
+        return fault ;
+      }
+      return rsVmCreate (d, m) ;
+    }
+    for i := range (n) {
+      old_nic := o[i].(map[string] interface{}) ;
+      new_nic := n[i].(map[string] interface{}) ;
+      if (old_nic["vlan"].(int) == new_nic["vlan"].(int)) &&
+         (strings.Compare (old_nic["mac"].(string), new_nic["mac"].(string)) == 0) {
+        continue ;
+      }
+      netdev_id := fmt.Sprintf ("netdev%d", i) ;
+      dev_id := fmt.Sprintf ("net%d", i) ;
+      f_log (fmt.Sprintf ("%s -> vlan:%d mac:%s", dev_id,
+                          new_nic["vlan"].(int), new_nic["mac"].(string))) ;
+      _, fault = f_qmpCommand (hypervisor, sock, f_qmpBuild ("device_del",
+                               map[string] interface{} { "id": dev_id })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      _, fault = f_qmpCommand (hypervisor, sock, f_qmpBuild ("netdev_del",
+                               map[string] interface{} { "id": netdev_id })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      _, fault = f_qmpCommand (hypervisor, sock, f_qmpBuild ("netdev_add",
+                               map[string] interface{} {
+                                 "type": "tap",
+                                 "id": netdev_id,
+                                 "script": fmt.Sprintf ("/root/bin/add_tap%d.sh",
+                                                        new_nic["vlan"].(int)),
+                               })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+      _, fault = f_qmpCommand (hypervisor, sock, f_qmpBuild ("device_add",
+                               map[string] interface{} {
+                                 "driver": "virtio-net-pci",
+                                 "id": dev_id,
+                                 "netdev": netdev_id,
+                                 "mac": new_nic["mac"].(string),
+                               })) ;
+      if (fault != nil) {
+        return fault ;
+      }
+    }
+  }
+
+  return nil ;
+}
+
+/*
+   This function deletes a running VM (ie, kill the qemu process). It returns
+   nil on success, otherwise an error is returned.
+*/
+
+func rsVmDelete (d *schema.ResourceData, m interface{}) error {
+  name := d.Get("name").(string) ;
+  f_log ("deleting VM : " + name) ;
+  hypervisor, pid, fault := f_vmExists (name) ;
+  if (len(hypervisor) > 0) && (pid > 1) && (fault == nil) {
+    ssh_cmd := fmt.Sprintf ("kill %d", pid) ;
+    _, _, fault := f_ssh (hypervisor, ssh_cmd) ;
+    if (fault != nil) {
+      return errors.New (fmt.Sprintf ("Failed to delete %s pid:%d on %s - %s",
+                                      name, pid, hypervisor)) ;
+    }
+    id := cfg_vmNamePrefix + "-" + name ;
+
+    /* reap any virtiofsd sidecars too - they don't die with qemu */
+
+    if state, fault := f_readVmState (hypervisor, id); fault == nil {
+      for i, fs_pid := range (state.FsPids) {
+        f_ssh (hypervisor, fmt.Sprintf ("kill %d", fs_pid)) ;
+        f_ssh (hypervisor, fmt.Sprintf ("rm -f %s", f_fsPidfilePath (id, i))) ;
+      }
+    }
+
+    f_ssh (hypervisor, fmt.Sprintf ("rm -f %s %s", f_vmStatePath (id), f_pidfilePath (id))) ;
+    f_vmIndexDelete (id) ;
+    if seed_img := f_seedImgName (d, id); len(seed_img) > 0 {
+      rbd_cmd := fmt.Sprintf ("rbd rm --no-progress %s/%s", G_seed_pool, seed_img) ;
+      f_log (fmt.Sprintf ("{%s}", rbd_cmd)) ;
+      f_ssh (G_ceph_hosts[0], rbd_cmd) ;
+    }
+    return nil ;
+  }
+  return errors.New ("Could not locate VM and pid of " + name)
+}
+
+/*
+   This function checks if the requested VM is running in any one of our
+   hypervisor hosts. We look for a VM with "-name" matching what we're looking
+   for. We return a true/false depending on our search, and set "error" if
+   something went wrong.
+*/
+
+func rsVmExists (d *schema.ResourceData, m interface{}) (bool, error) {
+  name := d.Get("name").(string) ;
   f_log ("searching for : " + name) ;
   hypervisor, _, fault := f_vmExists (name) ;
   if (fault != nil) {
@@ -549,6 +2028,15 @@ func rbdConfig (d *schema.ResourceData) (interface{}, error) {
   for _, v := range (d.Get("qemu_hosts").(*schema.Set).List()) {
     G_qemu_hosts = append (G_qemu_hosts, v.(string)) ;
   }
+  G_migrate_max_bandwidth_mbps = d.Get("migrate_max_bandwidth_mbps").(int) ;
+  G_migrate_max_downtime_ms = d.Get("migrate_max_downtime_ms").(int) ;
+  G_vm_index_cache = d.Get("vm_index_cache").(string) ;
+  G_seed_pool = d.Get("seed_pool").(string) ;
+  G_placement_strategy = d.Get("placement_strategy").(string) ;
+  G_sched_weight_mem = d.Get("sched_weight_mem").(float64) ;
+  G_sched_weight_cpu = d.Get("sched_weight_cpu").(float64) ;
+  G_sched_weight_load = d.Get("sched_weight_load").(float64) ;
+  G_sched_weight_disk = d.Get("sched_weight_disk").(float64) ;
   return nil, nil ;
 }
 
@@ -581,6 +2069,69 @@ func rbdItem () *schema.Resource {
   }
 }
 
+func snapshotItem () *schema.Resource {
+  return &schema.Resource {
+    Create: rsSnapCreate,
+    Read:   rsSnapRead,
+    Update: rsSnapUpdate,
+    Delete: rsSnapDelete,
+    Exists: rsSnapExists,
+
+    Schema: map[string] *schema.Schema {
+      "osd_pool": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "img_name": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "snap_name": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "protect": {
+        Type: schema.TypeBool,
+        Optional: true,
+        Default: false,
+      },
+    },
+  }
+}
+
+func cloneItem () *schema.Resource {
+  return &schema.Resource {
+    Create: rsCloneCreate,
+    Read:   rsCloneRead,
+    Update: rsCloneUpdate,
+    Delete: rsCloneDelete,
+    Exists: rsCloneExists,
+
+    Schema: map[string] *schema.Schema {
+      "parent_pool": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "parent_img": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "parent_snap": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "child_pool": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+      "child_img": {
+        Type: schema.TypeString,
+        Required: true,
+      },
+    },
+  }
+}
+
 func vmItem () *schema.Resource {
   return &schema.Resource {
     Create: rsVmCreate,
@@ -602,25 +2153,135 @@ func vmItem () *schema.Resource {
         Type: schema.TypeInt,
         Required: true,
       },
-      "vlan": {
+      "max_cpus": {
         Type: schema.TypeInt,
-        Required: true,
+        Optional: true,
+        Default: 64,
       },
-      "mac": {
-        Type: schema.TypeString,
-        Required: true,
+      "mem_slots": {
+        Type: schema.TypeInt,
+        Optional: true,
+        Default: 16,
+      },
+      "max_mem_mb": {
+        Type: schema.TypeInt,
+        Optional: true,
+        Default: 65536,
       },
       "vnc": {
         Type: schema.TypeString,
         Required: true,
       },
-      "osd_pool": {
-        Type: schema.TypeString,
+      "disk": {
+        Type: schema.TypeList,
         Required: true,
+        Elem: &schema.Resource {
+          Schema: map[string] *schema.Schema {
+            "osd_pool": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+            "img_name": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+            "cache": {
+              Type: schema.TypeString,
+              Optional: true,
+              Default: "writeback",
+            },
+          },
+        },
       },
-      "img_name": {
-        Type: schema.TypeString,
+      "nic": {
+        Type: schema.TypeList,
         Required: true,
+        Elem: &schema.Resource {
+          Schema: map[string] *schema.Schema {
+            "vlan": {
+              Type: schema.TypeInt,
+              Required: true,
+            },
+            "mac": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+          },
+        },
+      },
+      "fs": {
+        Type: schema.TypeList,
+        Optional: true,
+        Elem: &schema.Resource {
+          Schema: map[string] *schema.Schema {
+            "host_path": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+            "mount_tag": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+          },
+        },
+      },
+      "pmem": {
+        Type: schema.TypeList,
+        Optional: true,
+        Elem: &schema.Resource {
+          Schema: map[string] *schema.Schema {
+            "osd_pool": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+            "img_name": {
+              Type: schema.TypeString,
+              Required: true,
+            },
+            "size_mb": {
+              Type: schema.TypeInt,
+              Required: true,
+            },
+          },
+        },
+      },
+      "allow_migrate": {
+        Type: schema.TypeBool,
+        Optional: true,
+        Default: false,
+      },
+      "preferred_host": {
+        Type: schema.TypeString,
+        Optional: true,
+      },
+      "target_host": {
+        Type: schema.TypeString,
+        Optional: true,
+      },
+      "cloud_init": {
+        Type: schema.TypeList,
+        Optional: true,
+        MaxItems: 1,
+        Elem: &schema.Resource {
+          Schema: map[string] *schema.Schema {
+            "user_data": {
+              Type: schema.TypeString,
+              Optional: true,
+            },
+            "meta_data": {
+              Type: schema.TypeString,
+              Optional: true,
+            },
+            "network_config": {
+              Type: schema.TypeString,
+              Optional: true,
+            },
+            "hostname": {
+              Type: schema.TypeString,
+              Optional: true,
+            },
+          },
+        },
       },
     },
   }
@@ -655,10 +2316,56 @@ func rbdProvider() terraform.ResourceProvider {
         Type: schema.TypeString,
         Required: true,
       },
+      "migrate_max_bandwidth_mbps": {
+        Type: schema.TypeInt,
+        Optional: true,
+        Default: 220,
+      },
+      "migrate_max_downtime_ms": {
+        Type: schema.TypeInt,
+        Optional: true,
+        Default: 300,
+      },
+      "vm_index_cache": {
+        Type: schema.TypeString,
+        Optional: true,
+      },
+      "seed_pool": {
+        Type: schema.TypeString,
+        Optional: true,
+        Default: "rbd",
+      },
+      "placement_strategy": {
+        Type: schema.TypeString,
+        Optional: true,
+        Default: "most-free-mem",
+      },
+      "sched_weight_mem": {
+        Type: schema.TypeFloat,
+        Optional: true,
+        Default: 1.0,
+      },
+      "sched_weight_cpu": {
+        Type: schema.TypeFloat,
+        Optional: true,
+        Default: 4.0,
+      },
+      "sched_weight_load": {
+        Type: schema.TypeFloat,
+        Optional: true,
+        Default: 2.0,
+      },
+      "sched_weight_disk": {
+        Type: schema.TypeFloat,
+        Optional: true,
+        Default: 0.1,
+      },
     },
     ResourcesMap: map[string] *schema.Resource {
       cfg_rbdResourceName: rbdItem (),
       cfg_vmResourceName: vmItem (),
+      cfg_snapResourceName: snapshotItem (),
+      cfg_cloneResourceName: cloneItem (),
     },
     ConfigureFunc: rbdConfig,
   }